@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/weiliddat/estimate-work/session"
+)
+
+// setupAuthTest points the package globals updateRoomHandler depends on at
+// throwaway test values and restores them afterward, since they're normally
+// only set once in main().
+func setupAuthTest(t *testing.T) {
+	t.Helper()
+
+	prevMachineId, prevCookies, prevStore := machineId, cookies, roomStore
+	machineId = "test-machine"
+	store, err := session.NewStore(session.KeyPair{HMACKey: []byte("0123456789abcdef0123456789abcdef")})
+	if err != nil {
+		t.Fatalf("session.NewStore: %v", err)
+	}
+	cookies = store
+	roomStore = memoryStore{}
+
+	t.Cleanup(func() {
+		machineId, cookies, roomStore = prevMachineId, prevCookies, prevStore
+	})
+}
+
+func newTestRoom(t *testing.T) (room *Room, host *User, guest *User) {
+	t.Helper()
+
+	host = &User{Id: "host-id", Name: "Host"}
+	guest = &User{Id: "guest-id", Name: "Guest"}
+	room = &Room{
+		Id:        "test-room",
+		MachineId: machineId,
+		HostId:    host.Id,
+		Users:     []*User{host, guest},
+		Options:   []string{"1", "2", "3"},
+		Estimates: make(map[string]string),
+		UpdatedAt: time.Now(),
+	}
+
+	roomsMu.Lock()
+	rooms[room.Id] = room
+	roomsMu.Unlock()
+	t.Cleanup(func() {
+		roomsMu.Lock()
+		delete(rooms, room.Id)
+		roomsMu.Unlock()
+	})
+
+	return room, host, guest
+}
+
+func postUpdateRoom(t *testing.T, room *Room, userId string, form url.Values, hxRequest bool) *httptest.ResponseRecorder {
+	t.Helper()
+
+	encodedUserId, err := cookies.Encode("user", userId)
+	if err != nil {
+		t.Fatalf("cookies.Encode: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/room/"+machineId+"/"+room.Id, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if hxRequest {
+		req.Header.Set("hx-request", "true")
+	}
+	req.AddCookie(&http.Cookie{Name: "user", Value: encodedUserId})
+	req.SetPathValue("machine", machineId)
+	req.SetPathValue("room", room.Id)
+
+	w := httptest.NewRecorder()
+	updateRoomHandler(w, req)
+	return w
+}
+
+func TestUpdateRoomHandlerRejectsNonHostRename(t *testing.T) {
+	setupAuthTest(t)
+	room, _, guest := newTestRoom(t)
+
+	w := postUpdateRoom(t, room, guest.Id, url.Values{"name": {"Hijacked"}}, false)
+
+	if room.Name != "" {
+		t.Fatalf("room.Name = %q, want unchanged", room.Name)
+	}
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	if loc := w.Header().Get("Location"); loc != "/room/test-machine/test-room" {
+		t.Fatalf("Location = %q, want redirect back to the room page", loc)
+	}
+
+	found := false
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "flash" && c.Value != "" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected a flash cookie to be set on a rejected action")
+	}
+}
+
+func TestUpdateRoomHandlerRejectsNonHostRenameViaHxRedirect(t *testing.T) {
+	setupAuthTest(t)
+	room, _, guest := newTestRoom(t)
+
+	w := postUpdateRoom(t, room, guest.Id, url.Values{"name": {"Hijacked"}}, true)
+
+	if room.Name != "" {
+		t.Fatalf("room.Name = %q, want unchanged", room.Name)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d (HX-Redirect responses are 200)", w.Code, http.StatusOK)
+	}
+	if got := w.Header().Get("HX-Redirect"); got != "/room/test-machine/test-room" {
+		t.Fatalf("HX-Redirect = %q, want the room page", got)
+	}
+}
+
+func TestUpdateRoomHandlerAllowsHostRename(t *testing.T) {
+	setupAuthTest(t)
+	room, host, _ := newTestRoom(t)
+
+	postUpdateRoom(t, room, host.Id, url.Values{"name": {"New Name"}}, false)
+
+	if room.Name != "New Name" {
+		t.Fatalf("room.Name = %q, want %q", room.Name, "New Name")
+	}
+}
+
+func TestUpdateRoomHandlerJoinerBecomingHostCanSetRoomFieldsInSamePost(t *testing.T) {
+	setupAuthTest(t)
+
+	room := &Room{
+		Id:        "empty-room",
+		MachineId: machineId,
+		Users:     []*User{},
+		Options:   []string{"1", "2", "3"},
+		Estimates: make(map[string]string),
+		UpdatedAt: time.Now(),
+	}
+	roomsMu.Lock()
+	rooms[room.Id] = room
+	roomsMu.Unlock()
+	t.Cleanup(func() {
+		roomsMu.Lock()
+		delete(rooms, room.Id)
+		roomsMu.Unlock()
+	})
+
+	// The first joiner becomes host (room.HostId == ""); isHost must reflect
+	// that for the rest of this same request, not just the next one.
+	req := httptest.NewRequest(http.MethodPost, "/room/"+machineId+"/"+room.Id, strings.NewReader(
+		url.Values{"user-name": {"First"}, "name": {"Sprint Planning"}}.Encode(),
+	))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetPathValue("machine", machineId)
+	req.SetPathValue("room", room.Id)
+
+	w := httptest.NewRecorder()
+	updateRoomHandler(w, req)
+
+	if room.Name != "Sprint Planning" {
+		t.Fatalf("room.Name = %q, want %q (new host's own room-setup field should apply)", room.Name, "Sprint Planning")
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "flash" && c.Value != "" {
+			t.Fatalf("unexpected flash cookie %q for the new host's own request", c.Value)
+		}
+	}
+}
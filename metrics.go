@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are only ever served on DEBUG_ADDR (see startDebugServer), a
+// separate listener from the main HTTP one, so they never reach end users.
+var (
+	metricsRoomsTotal = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "rooms_total",
+		Help: "Number of rooms currently held in memory.",
+	}, func() float64 {
+		roomsMu.RLock()
+		defer roomsMu.RUnlock()
+		return float64(len(rooms))
+	})
+
+	metricsUsersTotal = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "users_total",
+		Help: "Number of users across all rooms.",
+	}, func() float64 {
+		roomsMu.RLock()
+		defer roomsMu.RUnlock()
+
+		total := 0
+		for _, room := range rooms {
+			room.mu.Lock()
+			total += len(room.Users)
+			room.mu.Unlock()
+		}
+		return float64(total)
+	})
+
+	metricsRoomSubscribers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "room_subscribers",
+		Help: "Number of long-poll/SSE subscribers currently held open, per room.",
+	}, []string{"room_id"})
+
+	metricsRoomUpdatesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "room_updates_total",
+		Help: "Count of room mutations handled, by action.",
+	}, []string{"action"})
+
+	metricsLongPollDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "long_poll_duration_seconds",
+		Help: "Time a long-poll request spent waiting for a room change.",
+	})
+
+	metricsDataFileWriteDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "data_file_write_duration_seconds",
+		Help: "Time spent saving a room to the configured RoomStore.",
+	})
+
+	metricsDataFileBytes = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "data_file_bytes",
+		Help: "Size in bytes of the on-disk data file, when using the file store.",
+	}, func() float64 {
+		fs, ok := roomStore.(*fileStore)
+		if !ok {
+			return 0
+		}
+		info, err := os.Stat(fs.path)
+		if err != nil {
+			return 0
+		}
+		return float64(info.Size())
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricsRoomsTotal,
+		metricsUsersTotal,
+		metricsRoomSubscribers,
+		metricsRoomUpdatesTotal,
+		metricsLongPollDuration,
+		metricsDataFileWriteDuration,
+		metricsDataFileBytes,
+	)
+}
+
+// timedSave saves room through roomStore while recording how long it took,
+// so slow backends (or a growing gob file) show up in
+// data_file_write_duration_seconds.
+func timedSave(room *Room) error {
+	timer := prometheus.NewTimer(metricsDataFileWriteDuration)
+	defer timer.ObserveDuration()
+	return roomStore.Save(room)
+}
+
+// startDebugServer exposes pprof and Prometheus metrics on their own
+// listener, kept separate from the main one so end users never see them.
+// DEBUG_ADDR is an optional side channel, so a failure here is logged and
+// returned rather than fatal: it must never take down the user-facing
+// listener started alongside it.
+func startDebugServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.Println("Debug server is listening on", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Println("Error running debug server:", err)
+	}
+}
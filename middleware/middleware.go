@@ -0,0 +1,178 @@
+// Package middleware provides a small set of composable http.Handler
+// wrappers: access logging, gzip compression, panic recovery, and request
+// ID propagation. None of it knows about rooms or users — callers supply
+// that context through plain functions so this package stays importable
+// from anywhere without pulling in application state.
+package middleware
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Chain composes middleware in the order given: the first wraps the
+// second, which wraps the third, and so on, so Chain(a, b, c)(handler)
+// runs a, then b, then c, then handler.
+func Chain(mw ...func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(final http.Handler) http.Handler {
+		for i := len(mw) - 1; i >= 0; i-- {
+			final = mw[i](final)
+		}
+		return final
+	}
+}
+
+type requestIDKey struct{}
+
+// RequestID stamps every request with an X-Request-ID (reusing one the
+// client already sent, if any) and threads it through the request context
+// so downstream log lines can be correlated back to a single request.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequestIDFromContext returns the request ID stamped by RequestID, or ""
+// if none is present.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Recover catches panics from the wrapped handler and hands them to
+// onPanic instead of letting them crash the server. Callers pass in their
+// own error-rendering handler so this package doesn't need to know about
+// it.
+func Recover(onPanic func(w http.ResponseWriter, r *http.Request, recovered any)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					onPanic(w, r, recovered)
+				}
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// statusWriter wraps a ResponseWriter to capture the status code and byte
+// count an access logger needs, since http.ResponseWriter exposes neither.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// Flush delegates to the underlying ResponseWriter if it supports
+// http.Flusher, so AccessLog wrapping a streaming handler (SSE, long-poll)
+// doesn't hide that capability behind the statusWriter's own type.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// RequestContext is whatever extra fields an AccessLog caller wants to
+// resolve per request, e.g. the machine/room/user a request resolved to.
+type RequestContext func(r *http.Request) (machineId, roomId, userId string)
+
+// AccessLog emits one structured line per request: method, path, status,
+// duration, request ID, and whatever resolve can determine about the
+// request (machine/room/user ids, when resolvable).
+func AccessLog(resolve RequestContext) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w}
+
+			next.ServeHTTP(sw, r)
+
+			var machineId, roomId, userId string
+			if resolve != nil {
+				machineId, roomId, userId = resolve(r)
+			}
+
+			log.Printf(
+				"request_id=%s method=%s path=%s status=%d bytes=%d duration=%s machine_id=%s room_id=%s user_id=%s",
+				RequestIDFromContext(r.Context()), r.Method, r.URL.Path, sw.status, sw.bytes, time.Since(start), machineId, roomId, userId,
+			)
+		})
+	}
+}
+
+// gzipResponseWriter makes a gzip.Writer satisfy http.ResponseWriter by
+// routing Write through it while leaving headers/status on the original.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	return w.gz.Write(b)
+}
+
+// Gzip compresses responses when the client advertises Accept-Encoding:
+// gzip, skipping any path ending in skipSuffixes so streaming responses
+// (long-poll, SSE) aren't buffered by the gzip writer.
+func Gzip(skipSuffixes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			for _, suffix := range skipSuffixes {
+				if strings.HasSuffix(r.URL.Path, suffix) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Add("Vary", "Accept-Encoding")
+
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+
+			next.ServeHTTP(&gzipResponseWriter{ResponseWriter: w, gz: gz}, r)
+		})
+	}
+}
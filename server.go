@@ -2,20 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"embed"
-	"encoding/gob"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"slices"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/weiliddat/estimate-work/middleware"
+	"github.com/weiliddat/estimate-work/session"
 )
 
 var (
@@ -25,15 +30,19 @@ var (
 	indexTmpl    = template.Must(template.New("index").Funcs(funcs).ParseFS(templatesFs, "templates/base.html", "templates/index.html"))
 	roomTmpl     = template.Must(template.New("room").Funcs(funcs).ParseFS(templatesFs, "templates/base.html", "templates/room.html"))
 	notFoundTmpl = template.Must(template.New("notFound").Funcs(funcs).ParseFS(templatesFs, "templates/base.html", "templates/not_found.html"))
+	roomsMu      sync.RWMutex
 	rooms        = make(map[string]*Room)
 	machineId    string
 	persistTime  = 10 * 24 * time.Hour
+	cookies      *session.Store
+	roomStore    RoomStore
 )
 
 type RenderContext struct {
 	User      *User
 	Room      *Room
 	MachineId string
+	Flash     string
 }
 
 type User struct {
@@ -56,7 +65,89 @@ type Room struct {
 
 	UpdatedAt time.Time
 	mu        sync.Mutex
-	subs      [](chan bool)
+	subs      []chan RoomEvent
+}
+
+// RoomEventKind identifies what changed in a Room so subscribers can render
+// only the fragment that's affected instead of the whole page.
+type RoomEventKind string
+
+const (
+	EventUserJoined      RoomEventKind = "user-joined"
+	EventEstimateChanged RoomEventKind = "estimate-changed"
+	EventRevealed        RoomEventKind = "revealed"
+	EventReset           RoomEventKind = "reset"
+	EventKicked          RoomEventKind = "kicked"
+	EventHostChanged     RoomEventKind = "host-changed"
+)
+
+// RoomEvent is what updateRoomHandler multicasts to subscribers of a Room,
+// one per (*Room).subs channel. Kinds holds every RoomEventKind produced by
+// a single mutation, so one POST that touches e.g. both the name and an
+// estimate is still exactly one send per subscriber.
+type RoomEvent struct {
+	Kinds []RoomEventKind
+	Room  *Room
+}
+
+// fragmentTemplates maps a RoomEventKind to the "room" sub-template that
+// renders just the part of the page that changed, for hx-swap-oob.
+var fragmentTemplates = map[RoomEventKind]string{
+	EventUserJoined:      "users-fragment",
+	EventEstimateChanged: "estimates-fragment",
+	EventRevealed:        "estimates-fragment",
+	EventReset:           "estimates-fragment",
+	EventKicked:          "users-fragment",
+	EventHostChanged:     "users-fragment",
+}
+
+// broadcast sends every kind from a single mutation to each subscriber as
+// one RoomEvent, without blocking. A subscriber whose buffer is full is
+// assumed stuck or gone; its channel is closed and dropped so the writer
+// never waits on a slow reader. Sending all of one mutation's kinds together
+// (instead of one broadcast call per kind) keeps a burst of same-request
+// events from filling a subscriber's buffer and getting it mistaken for
+// stuck. Dropped long-poll/SSE clients simply reconnect and get a fresh
+// subscription. Callers must hold r.mu.
+func (r *Room) broadcast(kinds ...RoomEventKind) {
+	if len(kinds) == 0 {
+		return
+	}
+
+	live := r.subs[:0]
+	for _, sub := range r.subs {
+		select {
+		case sub <- RoomEvent{Kinds: kinds, Room: r}:
+			live = append(live, sub)
+		default:
+			close(sub)
+		}
+	}
+	r.subs = live
+	metricsRoomSubscribers.WithLabelValues(r.Id).Set(float64(len(r.subs)))
+}
+
+// subscribe registers a new buffered subscriber channel for room change
+// events and returns it along with an unsubscribe func.
+func (r *Room) subscribe() (chan RoomEvent, func()) {
+	sub := make(chan RoomEvent, 1)
+
+	r.mu.Lock()
+	r.subs = append(r.subs, sub)
+	metricsRoomSubscribers.WithLabelValues(r.Id).Set(float64(len(r.subs)))
+	r.mu.Unlock()
+
+	unsubscribe := func() {
+		r.mu.Lock()
+		r.subs = slices.DeleteFunc(
+			r.subs,
+			func(s chan RoomEvent) bool { return s == sub },
+		)
+		metricsRoomSubscribers.WithLabelValues(r.Id).Set(float64(len(r.subs)))
+		r.mu.Unlock()
+	}
+
+	return sub, unsubscribe
 }
 
 func (r *Room) GetUser(id string) *User {
@@ -69,6 +160,35 @@ func (r *Room) GetUser(id string) *User {
 	return nil
 }
 
+// snapshot returns a detached copy of r's exported fields, safe to hand to a
+// RoomStore that may keep it around (and encode it) after this call
+// returns. Without this, a store that caches other rooms' live *Room
+// pointers between calls can end up gob-encoding a room's Users/Estimates
+// while a different request concurrently mutates them under that room's own
+// mu, which this lock+copy is the only thing actually holding off.
+func (r *Room) snapshot() *Room {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cp := &Room{
+		MachineId: r.MachineId,
+		Id:        r.Id,
+		Name:      r.Name,
+		HostId:    r.HostId,
+		Users:     append([]*User(nil), r.Users...),
+		Topic:     r.Topic,
+		Options:   append([]string(nil), r.Options...),
+		Estimates: make(map[string]string, len(r.Estimates)),
+		Revealed:  r.Revealed,
+		UpdatedAt: r.UpdatedAt,
+	}
+	for k, v := range r.Estimates {
+		cp.Estimates[k] = v
+	}
+
+	return cp
+}
+
 func (r *Room) DisplayName() string {
 	if r.Name != "" {
 		return r.Name
@@ -87,7 +207,9 @@ func NewRoom() *Room {
 		Estimates: make(map[string]string),
 		MachineId: machineId,
 	}
+	roomsMu.Lock()
 	rooms[room.Id] = &room
+	roomsMu.Unlock()
 	return &room
 }
 
@@ -97,40 +219,101 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 	err := indexTmpl.ExecuteTemplate(
 		w,
 		"base",
-		RenderContext{user, room, machineId},
+		newRenderContext(w, r, user, room),
 	)
 	if err != nil {
 		internalErrorHandler(w, r, err)
 	}
 }
 
+// signedCookie reads and verifies the named cookie, returning its decoded
+// value. A missing, malformed, or tampered cookie is treated the same as a
+// missing one, ok is false.
+func signedCookie(r *http.Request, name string) (value string, ok bool) {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return "", false
+	}
+
+	value, err = cookies.Decode(name, c.Value)
+	if err != nil {
+		return "", false
+	}
+
+	return value, true
+}
+
+// setFlash stores a short-lived message to be shown on the next page the
+// user loads, for rejections that happen mid-redirect (e.g. a non-host
+// action) where there's no response body to render an error into.
+func setFlash(w http.ResponseWriter, r *http.Request, message string) {
+	setSignedCookie(w, r, "flash", message, 10)
+}
+
+// popFlash reads and clears the flash cookie, if any, so a message is only
+// ever shown once.
+func popFlash(w http.ResponseWriter, r *http.Request) string {
+	message, ok := signedCookie(r, "flash")
+	if !ok {
+		return ""
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: "flash", Value: "", Path: "/", MaxAge: -1})
+
+	return message
+}
+
+// newRenderContext builds the RenderContext for a template render, popping
+// any pending flash message so every handler shows it exactly once.
+func newRenderContext(w http.ResponseWriter, r *http.Request, user *User, room *Room) RenderContext {
+	return RenderContext{
+		User:      user,
+		Room:      room,
+		MachineId: machineId,
+		Flash:     popFlash(w, r),
+	}
+}
+
 func getReqRoomUser(r *http.Request) (*Room, *User) {
 	var roomId, userId string
 
 	roomId = r.PathValue("room")
 	if roomId == "" {
-		roomCookie, err := r.Cookie("room")
-		if err == nil {
-			roomId = roomCookie.Value
-		}
+		roomId, _ = signedCookie(r, "room")
 	}
 
+	roomsMu.RLock()
 	room, exists := rooms[roomId]
+	roomsMu.RUnlock()
 	if !exists {
 		return nil, nil
 	}
 
-	userCookie, err := r.Cookie("user")
-	if err != nil {
+	var ok bool
+	userId, ok = signedCookie(r, "user")
+	if !ok {
 		return room, nil
 	}
-	userId = userCookie.Value
 
 	user := room.GetUser(userId)
 
 	return room, user
 }
 
+// resolveRequestContext lets middleware.AccessLog report which machine,
+// room, and user a request resolved to, without the middleware package
+// needing to know what a Room or User is.
+func resolveRequestContext(r *http.Request) (machineIdVal, roomId, userId string) {
+	room, user := getReqRoomUser(r)
+	if room != nil {
+		roomId = room.Id
+	}
+	if user != nil {
+		userId = user.Id
+	}
+	return machineId, roomId, userId
+}
+
 func getRoomHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println(machineId, "received request for", r.Method, r.URL)
 
@@ -149,13 +332,13 @@ func getRoomHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	setMachineId(w, machineId)
-	setRoomAndUserId(w, room, user)
+	setMachineId(w, r, machineId)
+	setRoomAndUserId(w, r, room, user)
 
 	err := roomTmpl.ExecuteTemplate(
 		w,
 		"base",
-		RenderContext{user, room, machineId},
+		newRenderContext(w, r, user, room),
 	)
 	if err != nil {
 		internalErrorHandler(w, r, err)
@@ -176,30 +359,37 @@ func getRoomUpdateHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Long polling
+	// Long polling, kept as a fallback for clients that can't hold an SSE
+	// connection open (see getRoomEventsHandler for the preferred path).
 	hasUpdates := true
+	shuttingDown := false
 	ifModifiedSince := r.Header.Get("If-Modified-Since")
 	ifModifiedSinceTime, err := time.Parse(time.RFC1123, ifModifiedSince)
 	if err == nil && !room.UpdatedAt.Truncate(time.Second).After(ifModifiedSinceTime) {
-		roomUpdates := make(chan bool, 1)
+		roomUpdates, unsubscribe := room.subscribe()
+		defer unsubscribe()
 
-		room.mu.Lock()
-		room.subs = append(room.subs, roomUpdates)
-		room.mu.Unlock()
+		pollTimer := prometheus.NewTimer(metricsLongPollDuration)
+		defer pollTimer.ObserveDuration()
 
 		select {
 		case <-r.Context().Done():
-		case <-roomUpdates:
+		case _, ok := <-roomUpdates:
+			if !ok {
+				// The server closed our subscription for shutdown; tell the
+				// client to stop long-polling rather than retry against a
+				// server that's going away.
+				shuttingDown = true
+			}
+			hasUpdates = ok
 		case <-time.After(20 * time.Second):
 			hasUpdates = false
 		}
+	}
 
-		room.mu.Lock()
-		room.subs = slices.DeleteFunc(
-			room.subs,
-			func(s chan bool) bool { return s == roomUpdates },
-		)
-		room.mu.Unlock()
+	if shuttingDown {
+		w.WriteHeader(http.StatusNoContent)
+		return
 	}
 
 	w.Header().Add("Last-Modified", room.UpdatedAt.Format(time.RFC1123))
@@ -219,16 +409,92 @@ func getRoomUpdateHandler(w http.ResponseWriter, r *http.Request) {
 	err = roomTmpl.ExecuteTemplate(
 		w,
 		templateName,
-		RenderContext{user, room, machineId},
+		newRenderContext(w, r, user, room),
 	)
 	if err != nil {
 		internalErrorHandler(w, r, err)
 	}
 }
 
+// getRoomEventsHandler streams room changes over Server-Sent Events. It
+// replaces the thundering-herd reconnect pattern of the long-poll endpoint:
+// the connection is held open and only the fragment affected by a change is
+// pushed, for the client to swap in with hx-swap-oob.
+func getRoomEventsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(machineId, "received request for", r.Method, r.URL)
+
+	urlMachineId := r.PathValue("machine")
+	if urlMachineId != machineId {
+		w.Header().Add("fly-replay", fmt.Sprintf("instance=%s", urlMachineId))
+		log.Println(machineId, "added header to redirect to", urlMachineId)
+		notFoundHandler(w, r)
+		return
+	}
+
+	room, user := getReqRoomUser(r)
+
+	if room == nil || user == nil {
+		notFoundHandler(w, r)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		internalErrorHandler(w, r, fmt.Errorf("response writer does not support flushing"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	roomEvents, unsubscribe := room.subscribe()
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-roomEvents:
+			if !ok {
+				// Dropped for being slow, or the server is shutting down.
+				// The client's EventSource will reconnect on its own.
+				return
+			}
+
+			// Render from a snapshot, not the live room: this fires on every
+			// broadcast (far more often than long-poll's ~20s cadence), and
+			// html/template ranging over room.Estimates while a handler
+			// mutates it under room.mu is an unrecoverable concurrent-map
+			// crash, not a catchable panic.
+			snap := room.snapshot()
+
+			seen := make(map[string]bool, len(ev.Kinds))
+			for _, kind := range ev.Kinds {
+				templateName, known := fragmentTemplates[kind]
+				if !known || seen[templateName] {
+					continue
+				}
+				seen[templateName] = true
+
+				var fragment bytes.Buffer
+				err := roomTmpl.ExecuteTemplate(&fragment, templateName, RenderContext{User: user, Room: snap, MachineId: machineId})
+				if err != nil {
+					log.Printf("Error %+v rendering SSE fragment %s for room %s\n", err, templateName, room.Id)
+					continue
+				}
+
+				fmt.Fprintf(w, "event: update\ndata: %s\n\n", strings.ReplaceAll(fragment.String(), "\n", ""))
+			}
+			flusher.Flush()
+		}
+	}
+}
+
 func createRoomHandler(w http.ResponseWriter, r *http.Request) {
 	room := NewRoom()
-	rooms[room.Id] = room
 
 	http.Redirect(w, r, fmt.Sprintf("/room/%s/%s", machineId, room.Id), http.StatusSeeOther)
 }
@@ -251,21 +517,26 @@ func updateRoomHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	hxRequest := r.Header.Get("hx-request") == "true"
+
 	room.mu.Lock()
 
+	var events []RoomEventKind
+	var forbidden string
+
 	newUserName := r.FormValue("user-name")
 	if newUserName != "" {
 		if user != nil {
 			// User exists, just update name
 			user.Name = newUserName
+			metricsRoomUpdatesTotal.WithLabelValues("rename-user").Inc()
 		} else {
 			// Create user and join room (as host if doesn't exist)
 			var userId string
 
 			// Reuse userId to rejoin other rooms
-			userCookie, err := r.Cookie("user")
-			if err == nil && userCookie != nil {
-				userId = userCookie.Value
+			if existingUserId, ok := signedCookie(r, "user"); ok {
+				userId = existingUserId
 			} else {
 				id, _ := uuid.NewV7()
 				userId = id.String()
@@ -281,14 +552,27 @@ func updateRoomHandler(w http.ResponseWriter, r *http.Request) {
 				room.HostId = user.Id
 			}
 
-			setMachineId(w, room.MachineId)
-			setRoomAndUserId(w, room, user)
+			setMachineId(w, r, room.MachineId)
+			setRoomAndUserId(w, r, room, user)
+			events = append(events, EventUserJoined)
+			metricsRoomUpdatesTotal.WithLabelValues("join").Inc()
 		}
 	}
 
+	// Computed after the join branch above: a first-time joiner who becomes
+	// host (room.HostId == "" case) needs isHost to reflect that before the
+	// room-setup fields below are checked, since one POST commonly submits
+	// user-name alongside name/options/etc.
+	isHost := user != nil && user.Id == room.HostId
+
 	newRoomName := r.FormValue("name")
 	if newRoomName != "" {
-		room.Name = newRoomName
+		if !isHost {
+			forbidden = "Only the host can rename the room"
+		} else {
+			room.Name = newRoomName
+			metricsRoomUpdatesTotal.WithLabelValues("rename").Inc()
+		}
 	}
 
 	newRoomTopic := r.FormValue("topic")
@@ -306,42 +590,84 @@ func updateRoomHandler(w http.ResponseWriter, r *http.Request) {
 		} else {
 			room.Estimates[user.Id] = newEstimate
 		}
+		events = append(events, EventEstimateChanged)
+		metricsRoomUpdatesTotal.WithLabelValues("estimate").Inc()
 	}
 
 	showEstimates := r.FormValue("show-estimates")
 	if showEstimates == "true" {
-		room.Revealed = true
+		if !isHost {
+			forbidden = "Only the host can reveal estimates"
+		} else {
+			room.Revealed = true
+			events = append(events, EventRevealed)
+			metricsRoomUpdatesTotal.WithLabelValues("reveal").Inc()
+		}
 	}
 
 	deleteEstimates := r.FormValue("delete-estimates")
 	if deleteEstimates == "true" {
-		room.Revealed = false
-		room.Estimates = make(map[string]string)
+		if !isHost {
+			forbidden = "Only the host can reset estimates"
+		} else {
+			room.Revealed = false
+			room.Estimates = make(map[string]string)
+			events = append(events, EventReset)
+			metricsRoomUpdatesTotal.WithLabelValues("reset").Inc()
+		}
 	}
 
 	newOptions := r.FormValue("options")
 	if newOptions != "" {
-		room.Options = []string{}
-		for _, v := range strings.Split(newOptions, ",") {
-			room.Options = append(room.Options, strings.TrimSpace(v))
+		if !isHost {
+			forbidden = "Only the host can change options"
+		} else {
+			room.Options = []string{}
+			for _, v := range strings.Split(newOptions, ",") {
+				room.Options = append(room.Options, strings.TrimSpace(v))
+			}
 		}
 	}
 
 	kickUsers := r.FormValue("kick")
 	if kickUsers == "true" {
-		room.Users = []*User{}
-		room.Estimates = make(map[string]string)
+		if !isHost {
+			forbidden = "Only the host can kick everyone"
+		} else {
+			room.Users = []*User{}
+			room.Estimates = make(map[string]string)
+			events = append(events, EventKicked)
+			metricsRoomUpdatesTotal.WithLabelValues("kick").Inc()
+		}
 	}
 
 	room.UpdatedAt = time.Now()
 
-	for _, sub := range room.subs {
-		sub <- true
-	}
+	room.broadcast(events...)
 
 	room.mu.Unlock()
 
-	hxRequest := r.Header.Get("hx-request") == "true"
+	// Saved after unlocking: RoomStore.Save snapshots the room, which takes
+	// room.mu itself.
+	if err := timedSave(room); err != nil {
+		log.Printf("Error %+v saving room %s to store\n", err, room.Id)
+	}
+
+	if forbidden != "" {
+		setFlash(w, r, forbidden)
+		if hxRequest {
+			// A plain 303 here would have htmx's XHR auto-follow the
+			// redirect and swap a whole "base" document into the request's
+			// partial swap target. HX-Redirect tells htmx to do a full
+			// browser navigation instead, so the flash actually renders.
+			w.Header().Set("HX-Redirect", fmt.Sprintf("/room/%s/%s", machineId, room.Id))
+			w.WriteHeader(http.StatusOK)
+		} else {
+			http.Redirect(w, r, fmt.Sprintf("/room/%s/%s", machineId, room.Id), http.StatusSeeOther)
+		}
+		return
+	}
+
 	if hxRequest {
 		http.Redirect(w, r, fmt.Sprintf("/room/%s/%s/update", machineId, room.Id), http.StatusSeeOther)
 	} else {
@@ -349,108 +675,173 @@ func updateRoomHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// transferHostHandler lets the current host hand the role to another user
+// in the room by id, so a host doesn't need to kick everyone just to leave.
+func transferHostHandler(w http.ResponseWriter, r *http.Request) {
+	urlMachineId := r.PathValue("machine")
+	if urlMachineId != machineId {
+		w.Header().Add("fly-replay", fmt.Sprintf("instance=%s", urlMachineId))
+		notFoundHandler(w, r)
+		return
+	}
+
+	room, user := getReqRoomUser(r)
+
+	if room == nil {
+		notFoundHandler(w, r)
+		return
+	}
+
+	if user == nil || user.Id != room.HostId {
+		setFlash(w, r, "Only the host can transfer the host role")
+		http.Redirect(w, r, fmt.Sprintf("/room/%s/%s", machineId, room.Id), http.StatusSeeOther)
+		return
+	}
+
+	newHostId := r.FormValue("user-id")
+
+	room.mu.Lock()
+	changed := room.GetUser(newHostId) != nil
+	if changed {
+		room.HostId = newHostId
+		room.UpdatedAt = time.Now()
+		room.broadcast(EventHostChanged)
+	}
+	room.mu.Unlock()
+
+	if changed {
+		if err := timedSave(room); err != nil {
+			log.Printf("Error %+v saving room %s to store\n", err, room.Id)
+		}
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/room/%s/%s", machineId, room.Id), http.StatusSeeOther)
+}
+
 func notFoundHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("hx-refresh", "true")
 	w.WriteHeader(http.StatusNotFound)
-	unsetMachineId(w)
-	err := notFoundTmpl.ExecuteTemplate(w, "base", RenderContext{nil, nil, machineId})
+	unsetMachineId(w, r)
+	err := notFoundTmpl.ExecuteTemplate(w, "base", RenderContext{MachineId: machineId})
 	if err != nil {
 		internalErrorHandler(w, r, err)
 	}
 }
 
 func internalErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
-	log.Printf("Error %+v caused by %+v\n", err, r)
+	log.Printf("Error %+v caused by %+v (request_id=%s)\n", err, r, middleware.RequestIDFromContext(r.Context()))
 	w.Header().Add("hx-refresh", "true")
 	w.WriteHeader(http.StatusInternalServerError)
 	io.WriteString(w, "Internal Server Error")
 }
 
-func readFromDataFile(dataFilePath string) {
-	dataFile, err := os.ReadFile(dataFilePath)
-	if os.IsNotExist(err) {
-		log.Println("Data file does not exist, OK")
-	} else if err != nil {
-		log.Fatal("Failed to read file: ", err)
-	} else {
-		dataBytes := bytes.NewBuffer(dataFile)
-		dataDecoder := gob.NewDecoder(dataBytes)
-		err = dataDecoder.Decode(&rooms)
-		if err != nil {
-			log.Fatal("Failed to serialize from file: ", err)
-		}
-		for _, room := range rooms {
-			room.MachineId = machineId
+func cleanupOldRooms() {
+	tenDaysAgo := time.Now().Add(-persistTime)
+
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+
+	for _, r := range rooms {
+		r.mu.Lock()
+		if r.UpdatedAt.Before(tenDaysAgo) {
+			log.Printf("Cleaning up room %+v", r)
+			delete(rooms, r.Id)
+			if err := roomStore.Delete(r.Id); err != nil {
+				log.Printf("Error %+v deleting room %s from store\n", err, r.Id)
+			}
 		}
-		log.Printf("Restored from data file %v rooms", len(rooms))
+		r.mu.Unlock()
 	}
 }
 
-func writeToDataFile(dataFilePath string) {
-	for _, r := range rooms {
-		r.mu.Lock()
+// closeAllSubs closes every room's subscriber channels, so long-poll and SSE
+// handlers blocked in a select return immediately instead of leaving
+// connections (and the server process) hanging during shutdown.
+func closeAllSubs() {
+	roomsMu.RLock()
+	defer roomsMu.RUnlock()
+
+	for _, room := range rooms {
+		room.mu.Lock()
+		for _, sub := range room.subs {
+			close(sub)
+		}
+		room.subs = nil
+		metricsRoomSubscribers.DeleteLabelValues(room.Id)
+		room.mu.Unlock()
 	}
-	dataFile, err := os.Create(dataFilePath)
-	if err != nil {
-		log.Fatal("Failed to create file: ", err)
+}
+
+// flushRooms saves every in-memory room to roomStore, as a final safety net
+// on shutdown: ordinary mutations are already saved incrementally by
+// updateRoomHandler, but this catches anything still only in memory.
+func flushRooms(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		roomsMu.RLock()
+		defer roomsMu.RUnlock()
+		for _, room := range rooms {
+			if err := timedSave(room); err != nil {
+				log.Printf("Error %+v flushing room %s on shutdown\n", err, room.Id)
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("Timed out flushing rooms on shutdown")
 	}
-	dataEncoder := gob.NewEncoder(dataFile)
-	err = dataEncoder.Encode(rooms)
+}
+
+// setSignedCookie signs value with the package-level cookie store and sets
+// it with the hardening flags every cookie this server emits should carry:
+// HttpOnly (no JS access), SameSite=Lax (basic CSRF protection), and Secure
+// when the request arrived over TLS.
+func setSignedCookie(w http.ResponseWriter, r *http.Request, name, value string, maxAge int) {
+	encoded, err := cookies.Encode(name, value)
 	if err != nil {
-		log.Fatal("Failed to serialize to file: ", err)
-	}
-	for _, r := range rooms {
-		r.mu.Unlock()
+		log.Printf("Error %+v signing cookie %s\n", err, name)
+		return
 	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    encoded,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   isSecureRequest(r),
+	})
 }
 
-func cleanupOldRooms() {
-	tenDaysAgo := time.Now().Add(-persistTime)
-	for _, r := range rooms {
-		r.mu.Lock()
-		if r.UpdatedAt.Before(tenDaysAgo) {
-			log.Printf("Cleaning up room %+v", r)
-			delete(rooms, r.Id)
-		} else {
-			r.mu.Unlock()
-		}
-	}
+// isSecureRequest reports whether the original client request was HTTPS.
+// r.TLS is never set in production: Fly's edge proxy terminates TLS and
+// forwards plain HTTP to the app, so it's only ever non-nil in tests or a
+// deployment that skips the proxy. X-Forwarded-Proto is what Fly sets to
+// tell us what the client actually used.
+func isSecureRequest(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
 }
 
-func setRoomAndUserId(w http.ResponseWriter, room *Room, user *User) {
+func setRoomAndUserId(w http.ResponseWriter, r *http.Request, room *Room, user *User) {
 	if room != nil {
-		http.SetCookie(w, &http.Cookie{
-			Name:   "room",
-			Value:  room.Id,
-			Path:   "/",
-			MaxAge: int(persistTime.Seconds()),
-		})
+		setSignedCookie(w, r, "room", room.Id, int(persistTime.Seconds()))
 	}
 
 	if user != nil {
-		http.SetCookie(w, &http.Cookie{
-			Name:   "user",
-			Value:  user.Id,
-			Path:   "/",
-			MaxAge: int(persistTime.Seconds()),
-		})
+		setSignedCookie(w, r, "user", user.Id, int(persistTime.Seconds()))
 	}
 }
 
-func setMachineId(w http.ResponseWriter, machineId string) {
-	http.SetCookie(w, &http.Cookie{
-		Name:  "machineId",
-		Value: machineId,
-		Path:  "/",
-	})
+func setMachineId(w http.ResponseWriter, r *http.Request, machineId string) {
+	setSignedCookie(w, r, "machineId", machineId, 0)
 }
 
-func unsetMachineId(w http.ResponseWriter) {
-	http.SetCookie(w, &http.Cookie{
-		Name:  "machineId",
-		Value: "",
-		Path:  "/",
-	})
+func unsetMachineId(w http.ResponseWriter, r *http.Request) {
+	setSignedCookie(w, r, "machineId", "", 0)
 }
 
 func slugify(s string) string {
@@ -460,31 +851,50 @@ func slugify(s string) string {
 func main() {
 	listenAddr := os.Getenv("LISTEN")
 	machineId = os.Getenv("FLY_MACHINE_ID")
-	dataFilePath := os.Getenv("DATA_FILE_PATH")
+	storeDsn := os.Getenv("STORE")
+	cookieKeys := os.Getenv("COOKIE_KEYS")
+	debugAddr := os.Getenv("DEBUG_ADDR")
 
 	// Env validation
 	if machineId == "" || listenAddr == "" {
 		log.Fatal("Missing environment variables")
 	}
-	if dataFilePath == "" {
-		log.Println("No DATA_FILE_PATH provided, rooms are only stored in memory")
+	if storeDsn == "" {
+		log.Println("No STORE provided, rooms are only stored in memory")
 	}
 
-	// Restore rooms if a data file is provided
-	if dataFilePath != "" {
-		gob.Register(Room{})
-		readFromDataFile(dataFilePath)
+	// Cookie signing/encryption keys
+	if cookieKeys == "" {
+		log.Fatal("Missing COOKIE_KEYS environment variable")
 	}
+	keys, err := session.KeysFromEnv(cookieKeys)
+	if err != nil {
+		log.Fatal("Failed to parse COOKIE_KEYS: ", err)
+	}
+	cookies, err = session.NewStore(keys...)
+	if err != nil {
+		log.Fatal("Failed to build cookie store: ", err)
+	}
+
+	// Set up the room store and restore whatever it already has
+	roomStore, err = NewRoomStore(storeDsn)
+	if err != nil {
+		log.Fatal("Failed to set up room store: ", err)
+	}
+	rooms, err = roomStore.LoadAll()
+	if err != nil {
+		log.Fatal("Failed to load rooms from store: ", err)
+	}
+	for _, room := range rooms {
+		room.MachineId = machineId
+	}
+	log.Printf("Restored %v rooms from store", len(rooms))
 
-	// Periodic cleanup and dump
-	writeInterval := time.NewTicker(1 * time.Second)
+	// Periodic cleanup of rooms nobody has touched in persistTime
+	cleanupInterval := time.NewTicker(1 * time.Second)
 	go func() {
-		for {
-			<-writeInterval.C
+		for range cleanupInterval.C {
 			cleanupOldRooms()
-			if dataFilePath != "" {
-				writeToDataFile(dataFilePath)
-			}
 		}
 	}()
 
@@ -496,7 +906,50 @@ func main() {
 	http.HandleFunc("GET /room/{machine}/{room}", getRoomHandler)
 	http.HandleFunc("POST /room/{machine}/{room}", updateRoomHandler)
 	http.HandleFunc("GET /room/{machine}/{room}/update", getRoomUpdateHandler)
+	http.HandleFunc("GET /room/{machine}/{room}/events", getRoomEventsHandler)
+	http.HandleFunc("POST /room/{machine}/{room}/transfer-host", transferHostHandler)
 
-	log.Println("Server is listening to", listenAddr, "on", machineId)
-	log.Fatal(http.ListenAndServe(listenAddr, nil))
+	if debugAddr != "" {
+		go startDebugServer(debugAddr)
+	}
+
+	chain := middleware.Chain(
+		middleware.RequestID,
+		middleware.AccessLog(resolveRequestContext),
+		middleware.Recover(func(w http.ResponseWriter, r *http.Request, recovered any) {
+			internalErrorHandler(w, r, fmt.Errorf("panic: %v", recovered))
+		}),
+		middleware.Gzip("/update", "/events"),
+	)
+
+	srv := &http.Server{Addr: listenAddr, Handler: chain(http.DefaultServeMux)}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		log.Println("Server is listening to", listenAddr, "on", machineId)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal("Server failed: ", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	log.Println("Shutting down...")
+
+	cleanupInterval.Stop()
+	closeAllSubs()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	flushRooms(shutdownCtx)
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error %+v shutting down HTTP server\n", err)
+	}
+	if err := roomStore.Close(); err != nil {
+		log.Printf("Error %+v closing room store\n", err)
+	}
 }
@@ -0,0 +1,119 @@
+package main
+
+import "testing"
+
+func TestRoomBroadcastCoalescesKindsIntoOneSend(t *testing.T) {
+	room := &Room{Id: "room-1", Estimates: map[string]string{}}
+	sub, unsubscribe := room.subscribe()
+	defer unsubscribe()
+
+	room.mu.Lock()
+	room.broadcast(EventUserJoined, EventEstimateChanged)
+	room.mu.Unlock()
+
+	select {
+	case ev, ok := <-sub:
+		if !ok {
+			t.Fatal("subscriber channel closed, want one event")
+		}
+		if len(ev.Kinds) != 2 || ev.Kinds[0] != EventUserJoined || ev.Kinds[1] != EventEstimateChanged {
+			t.Fatalf("Kinds = %v, want [user-joined estimate-changed]", ev.Kinds)
+		}
+	default:
+		t.Fatal("expected a buffered event, got none")
+	}
+
+	select {
+	case _, ok := <-sub:
+		if ok {
+			t.Fatal("expected no second event from a single broadcast call")
+		}
+	default:
+	}
+}
+
+func TestRoomBroadcastDropsOnlyFullSubscribers(t *testing.T) {
+	room := &Room{Id: "room-1", Estimates: map[string]string{}}
+
+	slow, unsubscribeSlow := room.subscribe()
+	defer unsubscribeSlow()
+	fast, unsubscribeFast := room.subscribe()
+	defer unsubscribeFast()
+
+	room.mu.Lock()
+	room.broadcast(EventReset)
+	room.mu.Unlock()
+
+	// Drain fast's buffer so it looks alive for the next broadcast; leave
+	// slow's buffer full so the next send has to drop it.
+	<-fast
+
+	room.mu.Lock()
+	room.broadcast(EventReset)
+	room.mu.Unlock()
+
+	// The first broadcast's event is still buffered in slow; a receive
+	// returns it before reporting the channel as closed.
+	if _, ok := <-slow; !ok {
+		t.Fatal("slow subscriber's first event should still be buffered")
+	}
+	if _, ok := <-slow; ok {
+		t.Fatal("slow subscriber's channel should have been closed, not sent to")
+	}
+	if _, ok := <-fast; !ok {
+		t.Fatal("fast subscriber's channel should still be open")
+	}
+
+	room.mu.Lock()
+	subsLeft := len(room.subs)
+	room.mu.Unlock()
+	if subsLeft != 1 {
+		t.Fatalf("len(room.subs) = %d, want 1 (slow subscriber dropped)", subsLeft)
+	}
+}
+
+func TestRoomSnapshotIsDetached(t *testing.T) {
+	room := &Room{
+		Id:        "room-1",
+		Users:     []*User{{Id: "u1", Name: "Alice"}},
+		Options:   []string{"1", "2"},
+		Estimates: map[string]string{"u1": "1"},
+	}
+
+	snap := room.snapshot()
+
+	room.mu.Lock()
+	room.Users = append(room.Users, &User{Id: "u2", Name: "Bob"})
+	room.Options = append(room.Options, "3")
+	room.Estimates["u1"] = "2"
+	room.mu.Unlock()
+
+	if len(snap.Users) != 1 {
+		t.Fatalf("snapshot Users mutated after live room changed: %v", snap.Users)
+	}
+	if len(snap.Options) != 2 {
+		t.Fatalf("snapshot Options mutated after live room changed: %v", snap.Options)
+	}
+	if snap.Estimates["u1"] != "1" {
+		t.Fatalf("snapshot Estimates mutated after live room changed: %v", snap.Estimates)
+	}
+}
+
+func TestRoomSubscribeUnsubscribeRemovesChannel(t *testing.T) {
+	room := &Room{Id: "room-1", Estimates: map[string]string{}}
+
+	_, unsubscribe := room.subscribe()
+	room.mu.Lock()
+	if len(room.subs) != 1 {
+		t.Fatalf("len(room.subs) = %d, want 1 after subscribe", len(room.subs))
+	}
+	room.mu.Unlock()
+
+	unsubscribe()
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if len(room.subs) != 0 {
+		t.Fatalf("len(room.subs) = %d, want 0 after unsubscribe", len(room.subs))
+	}
+}
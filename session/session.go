@@ -0,0 +1,202 @@
+// Package session provides signed (and optionally encrypted) cookie values,
+// modeled on gorilla/sessions' CookieStore. A Store holds one or more key
+// pairs so cookies can be rotated: the first pair signs and encrypts new
+// values, all pairs are tried when verifying an incoming cookie.
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrInvalidCookie is returned by Decode when a cookie value is malformed,
+// was signed with a key this Store doesn't know about, or was tampered with.
+var ErrInvalidCookie = errors.New("session: invalid cookie value")
+
+// KeyPair is one generation of signing (and optional encryption) keys.
+type KeyPair struct {
+	// HMACKey authenticates cookie values. Required, should be 32 bytes.
+	HMACKey []byte
+	// BlockKey encrypts cookie values with AES-GCM when set. Optional; must
+	// be a valid AES key length (16, 24, or 32 bytes) if provided.
+	BlockKey []byte
+}
+
+// Store signs, and optionally encrypts, cookie values using a current key
+// pair. Additional key pairs are accepted on Decode so keys can be rotated
+// without invalidating cookies already handed out.
+type Store struct {
+	keys []KeyPair
+}
+
+// KeysFromEnv parses a COOKIE_KEYS-style env value into key pairs: one or
+// more ";"-separated generations, newest first, each generation a ","
+// separated list of base64url keys (HMAC key, then an optional AES key),
+// e.g. "hmac1,aes1;hmac2,aes2" for a current pair plus a previous one kept
+// around for rotation.
+func KeysFromEnv(value string) ([]KeyPair, error) {
+	var keys []KeyPair
+
+	for _, generation := range strings.Split(value, ";") {
+		generation = strings.TrimSpace(generation)
+		if generation == "" {
+			continue
+		}
+
+		parts := strings.Split(generation, ",")
+		hmacKey, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, fmt.Errorf("session: decoding HMAC key: %w", err)
+		}
+
+		key := KeyPair{HMACKey: hmacKey}
+		if len(parts) > 1 && strings.TrimSpace(parts[1]) != "" {
+			blockKey, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(parts[1]))
+			if err != nil {
+				return nil, fmt.Errorf("session: decoding block key: %w", err)
+			}
+			key.BlockKey = blockKey
+		}
+
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("session: no keys found")
+	}
+
+	return keys, nil
+}
+
+// NewStore builds a Store from one or more key pairs. The first pair is used
+// to encode new cookies; all pairs are tried in order when decoding, which
+// is what makes rotation possible: deploy with [new, old], then later drop
+// old once existing cookies have expired.
+func NewStore(keys ...KeyPair) (*Store, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("session: at least one key pair is required")
+	}
+	for i, k := range keys {
+		if len(k.HMACKey) == 0 {
+			return nil, fmt.Errorf("session: key pair %d is missing an HMAC key", i)
+		}
+		if len(k.BlockKey) != 0 {
+			if _, err := aes.NewCipher(k.BlockKey); err != nil {
+				return nil, fmt.Errorf("session: key pair %d has an invalid block key: %w", i, err)
+			}
+		}
+	}
+	return &Store{keys: keys}, nil
+}
+
+// Encode signs value (and encrypts it, if the current key pair has a block
+// key) and returns the cookie-safe string to store. name is mixed into the
+// signature so a value can't be replayed under a different cookie name.
+func (s *Store) Encode(name, value string) (string, error) {
+	key := s.keys[0]
+
+	payload := []byte(value)
+	if len(key.BlockKey) != 0 {
+		encrypted, err := encrypt(key.BlockKey, payload)
+		if err != nil {
+			return "", fmt.Errorf("session: encoding %q: %w", name, err)
+		}
+		payload = encrypted
+	}
+
+	mac := sign(key.HMACKey, name, payload)
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac), nil
+}
+
+// Decode verifies and returns the value previously stored by Encode under
+// name. It tries every key pair the Store was built with, newest first, so a
+// cookie signed before a key rotation still decodes. Any mismatch, including
+// tampering, returns ErrInvalidCookie.
+func (s *Store) Decode(name, cookieValue string) (string, error) {
+	payloadPart, macPart, ok := strings.Cut(cookieValue, ".")
+	if !ok {
+		return "", ErrInvalidCookie
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(payloadPart)
+	if err != nil {
+		return "", ErrInvalidCookie
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(macPart)
+	if err != nil {
+		return "", ErrInvalidCookie
+	}
+
+	for _, key := range s.keys {
+		want := sign(key.HMACKey, name, payload)
+		if !hmac.Equal(mac, want) {
+			continue
+		}
+
+		plain := payload
+		if len(key.BlockKey) != 0 {
+			plain, err = decrypt(key.BlockKey, payload)
+			if err != nil {
+				return "", ErrInvalidCookie
+			}
+		}
+		return string(plain), nil
+	}
+
+	return "", ErrInvalidCookie
+}
+
+func sign(hmacKey []byte, name string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write([]byte(name))
+	mac.Write([]byte{'|'})
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func encrypt(blockKey, plain []byte) ([]byte, error) {
+	block, err := aes.NewCipher(blockKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+func decrypt(blockKey, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(blockKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := gcm.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, ErrInvalidCookie
+	}
+	nonce, ciphertext := sealed[:nonceSize], sealed[nonceSize:]
+
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
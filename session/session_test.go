@@ -0,0 +1,96 @@
+package session
+
+import "testing"
+
+func fakeStore(t *testing.T, blockKey []byte) *Store {
+	t.Helper()
+
+	store, err := NewStore(KeyPair{
+		HMACKey:  []byte("0123456789abcdef0123456789abcdef"),
+		BlockKey: blockKey,
+	})
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	return store
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	for name, blockKey := range map[string][]byte{
+		"signed only":           nil,
+		"signed and encrypted": []byte("0123456789abcdef"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := fakeStore(t, blockKey)
+
+			encoded, err := store.Encode("user", "user-id-123")
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+
+			decoded, err := store.Decode("user", encoded)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if decoded != "user-id-123" {
+				t.Fatalf("Decode = %q, want %q", decoded, "user-id-123")
+			}
+		})
+	}
+}
+
+func TestDecodeRejectsTamperedValue(t *testing.T) {
+	store := fakeStore(t, nil)
+
+	encoded, err := store.Encode("user", "user-id-123")
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	tampered := encoded[:len(encoded)-1] + "x"
+	if _, err := store.Decode("user", tampered); err != ErrInvalidCookie {
+		t.Fatalf("Decode(tampered) = %v, want %v", err, ErrInvalidCookie)
+	}
+}
+
+func TestDecodeRejectsWrongCookieName(t *testing.T) {
+	store := fakeStore(t, nil)
+
+	encoded, err := store.Encode("user", "user-id-123")
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	if _, err := store.Decode("room", encoded); err != ErrInvalidCookie {
+		t.Fatalf("Decode(wrong name) = %v, want %v", err, ErrInvalidCookie)
+	}
+}
+
+func TestDecodeSupportsRotatedKeys(t *testing.T) {
+	oldKey := KeyPair{HMACKey: []byte("old-key-old-key-old-key-old-key")}
+	newKey := KeyPair{HMACKey: []byte("new-key-new-key-new-key-new-key")}
+
+	oldStore, err := NewStore(oldKey)
+	if err != nil {
+		t.Fatalf("NewStore(old): %v", err)
+	}
+	encoded, err := oldStore.Encode("user", "user-id-123")
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	// The rotated store signs with newKey but still accepts cookies minted
+	// under oldKey until they expire.
+	rotatedStore, err := NewStore(newKey, oldKey)
+	if err != nil {
+		t.Fatalf("NewStore(new, old): %v", err)
+	}
+
+	decoded, err := rotatedStore.Decode("user", encoded)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if decoded != "user-id-123" {
+		t.Fatalf("Decode = %q, want %q", decoded, "user-id-123")
+	}
+}
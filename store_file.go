@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileStore is the original gob-backed RoomStore. It keeps its own copy of
+// the room map and rewrites the whole file on every Save/Delete, but now
+// atomically (via a temp file + os.Rename) so a crash mid-write can't leave
+// a truncated file behind, and only when something actually changed rather
+// than on a fixed timer.
+//
+// s.rooms must only ever hold detached copies (see (*Room).snapshot), never
+// the live *Room pointers shared with the app's global rooms map. Save only
+// locks the one room it's given, but writeAtomic gob-encodes every room in
+// s.rooms, including ones the caller holds no lock on; if s.rooms aliased
+// the live rooms, that encode would race whatever handler is concurrently
+// mutating one of those other rooms under its own mu.
+type fileStore struct {
+	path string
+
+	mu    sync.Mutex
+	rooms map[string]*Room
+}
+
+func newFileStore(path string) (*fileStore, error) {
+	return &fileStore{path: path, rooms: make(map[string]*Room)}, nil
+}
+
+func (s *fileStore) LoadAll() (map[string]*Room, error) {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return map[string]*Room{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	rooms := make(map[string]*Room)
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(&rooms); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.rooms = make(map[string]*Room, len(rooms))
+	for id, room := range rooms {
+		s.rooms[id] = room.snapshot()
+	}
+	s.mu.Unlock()
+
+	return rooms, nil
+}
+
+func (s *fileStore) Save(room *Room) error {
+	snapshot := room.snapshot()
+
+	s.mu.Lock()
+	s.rooms[room.Id] = snapshot
+	out := s.snapshotLocked()
+	s.mu.Unlock()
+
+	return s.writeAtomic(out)
+}
+
+func (s *fileStore) Delete(id string) error {
+	s.mu.Lock()
+	delete(s.rooms, id)
+	snapshot := s.snapshotLocked()
+	s.mu.Unlock()
+
+	return s.writeAtomic(snapshot)
+}
+
+func (s *fileStore) Close() error { return nil }
+
+func (s *fileStore) snapshotLocked() map[string]*Room {
+	snapshot := make(map[string]*Room, len(s.rooms))
+	for id, room := range s.rooms {
+		snapshot[id] = room
+	}
+	return snapshot
+}
+
+func (s *fileStore) writeAtomic(rooms map[string]*Room) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".rooms-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := gob.NewEncoder(tmp).Encode(rooms); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
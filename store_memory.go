@@ -0,0 +1,10 @@
+package main
+
+// memoryStore is the RoomStore used when no STORE dsn is configured: rooms
+// only ever live in the in-process `rooms` map and are lost on restart.
+type memoryStore struct{}
+
+func (memoryStore) LoadAll() (map[string]*Room, error) { return map[string]*Room{}, nil }
+func (memoryStore) Save(*Room) error                    { return nil }
+func (memoryStore) Delete(string) error                 { return nil }
+func (memoryStore) Close() error                        { return nil }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteStore is a RoomStore with one row per room, so multiple Fly machines
+// can share a volume without one writer's full-file dump racing another's.
+// Each room is still gob-encoded, just into a BLOB column instead of a
+// single file-wide blob. Save gob-encodes a (*Room).snapshot(), not the live
+// room, so a concurrent request mutating the same room under its own mu
+// can't race the encode.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func newSQLiteStore(dataSourceName string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS rooms (
+			id         TEXT PRIMARY KEY,
+			machine_id TEXT NOT NULL,
+			updated_at INTEGER NOT NULL,
+			blob       BLOB NOT NULL
+		)
+	`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) LoadAll() (map[string]*Room, error) {
+	rows, err := s.db.Query(`SELECT blob FROM rooms`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := make(map[string]*Room)
+	for rows.Next() {
+		var blob []byte
+		if err := rows.Scan(&blob); err != nil {
+			return nil, err
+		}
+
+		var room Room
+		if err := gob.NewDecoder(bytes.NewReader(blob)).Decode(&room); err != nil {
+			return nil, err
+		}
+		rooms[room.Id] = &room
+	}
+
+	return rooms, rows.Err()
+}
+
+func (s *sqliteStore) Save(room *Room) error {
+	snapshot := room.snapshot()
+
+	var blob bytes.Buffer
+	if err := gob.NewEncoder(&blob).Encode(snapshot); err != nil {
+		return err
+	}
+
+	_, err := s.db.Exec(`
+		INSERT INTO rooms (id, machine_id, updated_at, blob) VALUES (?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			machine_id = excluded.machine_id,
+			updated_at = excluded.updated_at,
+			blob       = excluded.blob
+	`, snapshot.Id, snapshot.MachineId, snapshot.UpdatedAt.Unix(), blob.Bytes())
+	return err
+}
+
+func (s *sqliteStore) Delete(id string) error {
+	_, err := s.db.Exec(`DELETE FROM rooms WHERE id = ?`, id)
+	return err
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestNewRoomStoreDispatchesOnDsnScheme(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		dsn     string
+		want    any
+		wantErr bool
+	}{
+		{name: "empty dsn", dsn: "", want: memoryStore{}},
+		{name: "file scheme", dsn: "file://" + filepath.Join(dir, "rooms.gob"), want: &fileStore{}},
+		{name: "sqlite scheme", dsn: "sqlite://" + filepath.Join(dir, "rooms.db"), want: &sqliteStore{}},
+		{name: "unrecognized scheme", dsn: "redis://localhost", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := NewRoomStore(tt.dsn)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("NewRoomStore: expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewRoomStore: %v", err)
+			}
+			defer store.Close()
+
+			switch tt.want.(type) {
+			case memoryStore:
+				if _, ok := store.(memoryStore); !ok {
+					t.Fatalf("NewRoomStore(%q) = %T, want memoryStore", tt.dsn, store)
+				}
+			case *fileStore:
+				if _, ok := store.(*fileStore); !ok {
+					t.Fatalf("NewRoomStore(%q) = %T, want *fileStore", tt.dsn, store)
+				}
+			case *sqliteStore:
+				if _, ok := store.(*sqliteStore); !ok {
+					t.Fatalf("NewRoomStore(%q) = %T, want *sqliteStore", tt.dsn, store)
+				}
+			}
+		})
+	}
+}
+
+func testRoomStoreSaveLoadDelete(t *testing.T, store RoomStore) {
+	t.Helper()
+
+	room := &Room{
+		Id:        "room-1",
+		MachineId: "machine-1",
+		Name:      "Sprint Planning",
+		Users:     []*User{{Id: "u1", Name: "Alice"}},
+		Options:   []string{"1", "2", "3"},
+		Estimates: map[string]string{"u1": "2"},
+	}
+
+	if err := store.Save(room); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	loaded, err := store.LoadAll()
+	if err != nil {
+		t.Fatalf("LoadAll: %v", err)
+	}
+	got, ok := loaded[room.Id]
+	if !ok {
+		t.Fatalf("LoadAll() = %v, want an entry for %q", loaded, room.Id)
+	}
+	if got.Name != room.Name || got.Estimates["u1"] != "2" {
+		t.Fatalf("LoadAll()[%q] = %+v, want it to round-trip Save's room", room.Id, got)
+	}
+
+	if err := store.Delete(room.Id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	loaded, err = store.LoadAll()
+	if err != nil {
+		t.Fatalf("LoadAll after Delete: %v", err)
+	}
+	if _, ok := loaded[room.Id]; ok {
+		t.Fatalf("LoadAll() still has %q after Delete", room.Id)
+	}
+}
+
+func testRoomStoreSaveSnapshotsRoom(t *testing.T, store RoomStore) {
+	t.Helper()
+
+	room := &Room{
+		Id:        "room-1",
+		MachineId: "machine-1",
+		Estimates: map[string]string{"u1": "2"},
+	}
+
+	if err := store.Save(room); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	// Mutate the live room after Save returns. A store that kept the live
+	// pointer (instead of room.snapshot()) would reflect this on the next
+	// Save of any room, since the whole cache gets re-encoded.
+	room.Estimates["u1"] = "mutated-after-save"
+
+	other := &Room{Id: "room-2", MachineId: "machine-1", Estimates: map[string]string{}}
+	if err := store.Save(other); err != nil {
+		t.Fatalf("Save(other): %v", err)
+	}
+
+	loaded, err := store.LoadAll()
+	if err != nil {
+		t.Fatalf("LoadAll: %v", err)
+	}
+	if got := loaded["room-1"].Estimates["u1"]; got != "2" {
+		t.Fatalf("loaded room-1 Estimates[u1] = %q, want %q (Save should have snapshotted, not aliased)", got, "2")
+	}
+}
+
+func TestFileStoreSaveLoadDelete(t *testing.T) {
+	store, err := newFileStore(filepath.Join(t.TempDir(), "rooms.gob"))
+	if err != nil {
+		t.Fatalf("newFileStore: %v", err)
+	}
+	defer store.Close()
+
+	testRoomStoreSaveLoadDelete(t, store)
+}
+
+func TestFileStoreSaveSnapshotsRoom(t *testing.T) {
+	store, err := newFileStore(filepath.Join(t.TempDir(), "rooms.gob"))
+	if err != nil {
+		t.Fatalf("newFileStore: %v", err)
+	}
+	defer store.Close()
+
+	testRoomStoreSaveSnapshotsRoom(t, store)
+}
+
+func TestSQLiteStoreSaveLoadDelete(t *testing.T) {
+	store, err := newSQLiteStore(filepath.Join(t.TempDir(), "rooms.db"))
+	if err != nil {
+		t.Fatalf("newSQLiteStore: %v", err)
+	}
+	defer store.Close()
+
+	testRoomStoreSaveLoadDelete(t, store)
+}
+
+func TestSQLiteStoreSaveSnapshotsRoom(t *testing.T) {
+	store, err := newSQLiteStore(filepath.Join(t.TempDir(), "rooms.db"))
+	if err != nil {
+		t.Fatalf("newSQLiteStore: %v", err)
+	}
+	defer store.Close()
+
+	testRoomStoreSaveSnapshotsRoom(t, store)
+}